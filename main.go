@@ -2,17 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/mergepatch"
-	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
+
+	"github.com/Huang-Wei/tryout-kube-strategic-merge-patch/pkg/podutil"
+	"github.com/Huang-Wei/tryout-kube-strategic-merge-patch/pkg/preconditions"
 )
 
 var (
@@ -64,7 +63,9 @@ func main() {
 		klog.Fatalf("Expect error when updating Pod using a stale version, but got nil.")
 	}
 	// Still use the stale Pod, but operate with Patch.
-	if err := PatchPodStatus(cs, pod, ""); err != nil {
+	clearedStatus := pod.Status.DeepCopy()
+	clearedStatus.NominatedNodeName = ""
+	if _, _, _, err := podutil.PatchPodStatus(context.TODO(), cs, pod, *clearedStatus, podutil.PatchOptions{}); err != nil {
 		klog.Fatalf("PatchPod with stale version: %v.", err)
 	}
 	// Verify the Pod is patched properly.
@@ -81,13 +82,18 @@ func main() {
 	if err := BindPod(cs, pod, nodeName); err != nil {
 		klog.Fatalf("Cannot update Pod: %v", err)
 	}
-	// Try Patch the Pod using a stale version.
-	// Note here we are passing in a mergepatch.PreconditionFunc to avoid Patch a Pod which
-	// has its .spec.nodeName changed.
-	if err := PatchPodStatus(cs, pod, nnn, RequireSpecKeyUnchanged("nodeName")); err != nil {
+	// Try Patch the Pod using a stale version. Note here we are passing in a
+	// mergepatch.PreconditionFunc to avoid patching a Pod whose .spec.nodeName
+	// has changed: pod hasn't been refetched since before BindPod, so
+	// PatchPodStatus has to re-fetch the live pod itself to evaluate this
+	// precondition, and it should see the live .spec.nodeName that Bind just
+	// set and refuse to patch.
+	reboundStatus := pod.Status.DeepCopy()
+	reboundStatus.NominatedNodeName = nnn
+	if _, _, _, err := podutil.PatchPodStatus(context.TODO(), cs, pod, *reboundStatus, podutil.PatchOptions{}, preconditions.RequireJSONPathUnchanged("spec.nodeName")); err != nil {
 		klog.Infof("PatchPod with stale version: %v", err)
 	} else {
-		klog.Fatalf("Expect error when updating Pod using a stale version, but got nil.")
+		klog.Fatalf("Expect error when patching a Pod whose .spec.nodeName changed, but got nil.")
 	}
 }
 
@@ -117,42 +123,6 @@ func UpdatePodStatus(cs kubernetes.Interface, pod *v1.Pod, nnn string) error {
 	return err
 }
 
-func PatchPodStatus(cs kubernetes.Interface, pod *v1.Pod, nnn string, fns ...mergepatch.PreconditionFunc) error {
-	podCopy := pod.DeepCopy()
-	oldData, err := json.Marshal(podCopy)
-	if err != nil {
-		return err
-	}
-	// if fns is not nil, fetch the live version.
-	if len(fns) != 0 {
-		livePod, err := GetPod(cs, pod.Namespace, pod.Name)
-		if err != nil {
-			return err
-		}
-		podCopy = livePod.DeepCopy()
-	}
-	podCopy.Status.NominatedNodeName = nnn
-	newData, err := json.Marshal(podCopy)
-	if err != nil {
-		return err
-	}
-
-	patchData, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, &v1.Pod{}, fns...)
-	if err != nil {
-		return err
-	}
-
-	_, err = cs.CoreV1().Pods(pod.Namespace).Patch(
-		context.TODO(),
-		pod.Name,
-		types.StrategicMergePatchType,
-		patchData,
-		metav1.PatchOptions{},
-		"status",
-	)
-	return err
-}
-
 func GetPod(cs kubernetes.Interface, ns, name string) (*v1.Pod, error) {
 	return cs.CoreV1().Pods(ns).Get(context.TODO(), name, metav1.GetOptions{})
 }
@@ -177,22 +147,3 @@ func UpdatePod(cs kubernetes.Interface, pod *v1.Pod) error {
 	_, err := cs.CoreV1().Pods(pod.Namespace).Update(context.TODO(), podCopy, metav1.UpdateOptions{})
 	return err
 }
-
-func RequireSpecKeyUnchanged(key string) mergepatch.PreconditionFunc {
-	return func(patch interface{}) bool {
-		patchMap, ok := patch.(map[string]interface{})
-		if !ok {
-			return true
-		}
-		patchMap1, ok := patchMap["spec"]
-		if !ok {
-			return true
-		}
-		patchMap2, ok := patchMap1.(map[string]interface{})
-		if !ok {
-			return true
-		}
-		_, ok = patchMap2[key]
-		return !ok
-	}
-}
@@ -0,0 +1,381 @@
+// Package podutil provides helpers for updating a Pod's status subresource
+// via strategic-merge patches, mirroring the pattern used throughout
+// k8s.io/kubernetes (e.g. pkg/util/pod and the kube-scheduler's status
+// writer) so callers don't have to hand-roll marshal/diff/patch plumbing.
+package podutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/mattbaird/jsonpatch"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/mergepatch"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PatchOptions selects the wire format PatchPodStatus uses to talk to the
+// API server.
+type PatchOptions struct {
+	// PatchType is one of types.StrategicMergePatchType,
+	// types.JSONPatchType, or types.ApplyPatchType. The zero value behaves
+	// as types.StrategicMergePatchType.
+	PatchType types.PatchType
+	// FieldManager identifies the caller to server-side apply. Required
+	// when PatchType is types.ApplyPatchType; ignored otherwise.
+	FieldManager string
+}
+
+// PatchPodStatus patches the status subresource of oldPod, using the wire
+// format selected by opts.PatchType. oldPod is the caller's last-known view
+// of the pod; it need not be fresh, but its Namespace/Name/UID must be
+// correct.
+//
+// fns is always evaluated against a strategic-merge-style diff, regardless
+// of which PatchType ends up on the wire, so a precondition fails (or
+// passes) the same way no matter which format the caller picked. If the
+// status hasn't changed at all, the API round-trip is skipped entirely and
+// unchanged is returned true.
+//
+// When fns is non-empty, the diff fed to them is computed against the live
+// pod rather than oldPod, so a precondition like
+// preconditions.RequireJSONPathUnchanged("spec.nodeName") can actually
+// observe drift that happened after oldPod was fetched (e.g. a concurrent
+// Bind) - diffing oldPod against itself would never show such a change.
+// When fns is empty, that extra Get is skipped, since there's nothing to
+// evaluate it against.
+//
+// Only that check, and the implicit uid precondition described below, are
+// consistent across patch types - fns itself is NOT translated into a
+// server-side check for types.JSONPatchType or types.ApplyPatchType, since
+// mergepatch.PreconditionFunc is an opaque predicate over the computed
+// patch map with no path information to translate into a JSON Patch "test"
+// op. That leaves a narrow window, for those two patch types only, between
+// the live Get used to evaluate fns and the actual Patch call, in which a
+// precondition that held at evaluation time could be invalidated by a
+// concurrent change that the wire-level patch itself won't catch. uid is
+// the exception: because it's tracked explicitly rather than through fns,
+// it gets its own wire-level check for every patch type.
+//
+// For types.StrategicMergePatchType (the default / zero value), the
+// fns diff is what's sent, so there's no such window: the live read fns
+// was evaluated against is exactly what's on the wire. uid is injected
+// into the new side of that diff so that it always appears in the computed
+// patch; this turns the patch into an implicit precondition against the
+// pod having been deleted and recreated out from under the caller, since
+// uid is immutable and the API server rejects any attempt to change it.
+//
+// For types.JSONPatchType, an RFC 6902 patch is generated by diffing the
+// full old and new status documents, with an explicit "test" op on
+// /metadata/uid prepended so the server enforces the same uid precondition
+// natively instead of it being folded into a merge diff.
+//
+// For types.ApplyPatchType, opts.FieldManager is required. A minimal apply
+// configuration - just enough of a Pod to carry the mutated status fields,
+// plus uid for the same reason as above - is sent with that FieldManager,
+// so the caller only ever claims ownership of the fields it actually
+// changed.
+func PatchPodStatus(ctx context.Context, cs kubernetes.Interface, oldPod *v1.Pod, newStatus v1.PodStatus, opts PatchOptions, fns ...mergepatch.PreconditionFunc) (*v1.Pod, []byte, bool, error) {
+	namespace, name, uid := oldPod.Namespace, oldPod.Name, oldPod.UID
+
+	mergePatchBytes, unchanged, err := preparePatchBytesForPodStatus(ctx, cs, oldPod, newStatus, fns...)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if unchanged {
+		return nil, mergePatchBytes, true, nil
+	}
+
+	switch opts.PatchType {
+	case "", types.StrategicMergePatchType:
+		updatedPod, err := patchPodStatus(ctx, cs, namespace, name, types.StrategicMergePatchType, mergePatchBytes, metav1.PatchOptions{})
+		return updatedPod, mergePatchBytes, false, err
+
+	case types.JSONPatchType:
+		patchBytes, err := jsonPatchBytesForPodStatus(uid, oldPod.Status, newStatus)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		updatedPod, err := patchPodStatus(ctx, cs, namespace, name, types.JSONPatchType, patchBytes, metav1.PatchOptions{})
+		return updatedPod, patchBytes, false, err
+
+	case types.ApplyPatchType:
+		if opts.FieldManager == "" {
+			return nil, nil, false, fmt.Errorf("FieldManager is required for %s patches", types.ApplyPatchType)
+		}
+		_, newDelta, _ := diffPodStatus(&oldPod.Status, &newStatus)
+		patchBytes, err := applyPatchBytesForPodStatus(namespace, name, uid, newDelta)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		updatedPod, err := patchPodStatus(ctx, cs, namespace, name, types.ApplyPatchType, patchBytes, metav1.PatchOptions{FieldManager: opts.FieldManager})
+		return updatedPod, patchBytes, false, err
+
+	default:
+		return nil, nil, false, fmt.Errorf("unsupported patch type %q", opts.PatchType)
+	}
+}
+
+// patchPodStatus issues the actual status-subresource Patch call, wrapping
+// any error with the patch bytes and pod identity for easier debugging.
+func patchPodStatus(ctx context.Context, cs kubernetes.Interface, namespace, name string, patchType types.PatchType, patchBytes []byte, patchOpts metav1.PatchOptions) (*v1.Pod, error) {
+	updatedPod, err := cs.CoreV1().Pods(namespace).Patch(ctx, name, patchType, patchBytes, patchOpts, "status")
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch status %q for pod %s/%s: %w", patchBytes, namespace, name, err)
+	}
+	return updatedPod, nil
+}
+
+// jsonPatchBytesForPodStatus builds an RFC 6902 JSON Patch for the status
+// subresource by diffing the full old and new status documents with
+// mattbaird/jsonpatch. A "test" op asserting the pod's uid is prepended so
+// this patch type carries the same uid precondition as the strategic-merge
+// path, this time enforced natively by the API server rather than folded
+// into a merge diff. Any other preconditions the caller passed to
+// PatchPodStatus were already checked against a live read before this is
+// called, but - unlike uid - aren't re-asserted here: see the PatchPodStatus
+// doc comment for the resulting race window.
+func jsonPatchBytesForPodStatus(uid types.UID, oldStatus, newStatus v1.PodStatus) ([]byte, error) {
+	oldData, err := json.Marshal(map[string]interface{}{"status": oldStatus})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal old status: %v", err)
+	}
+	newData, err := json.Marshal(map[string]interface{}{"status": newStatus})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal new status: %v", err)
+	}
+
+	ops, err := jsonpatch.CreatePatch(oldData, newData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JSON patch: %v", err)
+	}
+	ops = append([]jsonpatch.JsonPatchOperation{jsonpatch.NewPatch("test", "/metadata/uid", string(uid))}, ops...)
+
+	return json.Marshal(ops)
+}
+
+// podStatusApplyConfiguration is a minimal stand-in for the generated
+// v1.PodApplyConfiguration: just enough of a Pod to carry a status through
+// server-side apply.
+type podStatusApplyConfiguration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Status            v1.PodStatus `json:"status,omitempty"`
+}
+
+// applyPatchBytesForPodStatus builds the request body for a
+// types.ApplyPatchType patch, limited to statusDelta so the caller only
+// claims ownership of the fields it's actually setting. uid is set on the
+// apply configuration's ObjectMeta for the same reason it's folded into the
+// strategic-merge and JSON Patch bodies: it's immutable, so the API server
+// rejects the apply outright if the pod was deleted and recreated since the
+// caller last observed it.
+func applyPatchBytesForPodStatus(namespace, name string, uid types.UID, statusDelta v1.PodStatus) ([]byte, error) {
+	apply := podStatusApplyConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: uid},
+		Status:     statusDelta,
+	}
+	data, err := json.Marshal(apply)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal apply configuration for pod %s/%s: %v", namespace, name, err)
+	}
+	return data, nil
+}
+
+// preparePatchBytesForPodStatus builds the strategic-merge patch that
+// PatchPodStatus sends (or, for other PatchTypes, runs fns against). unchanged
+// is true when oldPod.Status and newStatus are identical, in which case no
+// further work is done and the API round-trip is skipped.
+//
+// That unchanged check is deliberately done on status alone, wrapped in a
+// bare Pod, before anything else: folding in the uid or the rest of the pod
+// this early would make every patch - even a no-op one - look "changed" and
+// defeat the short-circuit. uid and the rest of oldPod only enter the
+// comparison once we know the status actually changed and we're about to
+// talk to the API server.
+//
+// If fns is non-empty the precondition diff is computed against the live
+// pod rather than oldPod: see the PatchPodStatus doc comment for why. If
+// fns is empty, oldPod is diffed against itself (aside from the status and
+// uid changes below), so this costs nothing beyond what a status-only diff
+// would.
+func preparePatchBytesForPodStatus(ctx context.Context, cs kubernetes.Interface, oldPod *v1.Pod, newStatus v1.PodStatus, fns ...mergepatch.PreconditionFunc) ([]byte, bool, error) {
+	namespace, name, uid := oldPod.Namespace, oldPod.Name, oldPod.UID
+
+	oldStatusData, err := json.Marshal(v1.Pod{Status: oldPod.Status})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal old status for pod %s/%s: %v", namespace, name, err)
+	}
+	newStatusData, err := json.Marshal(v1.Pod{Status: newStatus})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal new status for pod %s/%s: %v", namespace, name, err)
+	}
+	if bytes.Equal(oldStatusData, newStatusData) {
+		return []byte("{}"), true, nil
+	}
+
+	newBase := oldPod
+	if len(fns) != 0 {
+		livePod, err := cs.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to fetch live pod %s/%s for precondition check: %w", namespace, name, err)
+		}
+		newBase = livePod
+	}
+
+	// oldPod is marshalled with its uid cleared, and newPod with uid
+	// re-added below, so the two sides always disagree on uid even when
+	// nothing else changed: the API server rejects any patch that tries to
+	// change an object's immutable uid, so embedding the uid the caller
+	// believes is current turns a stale Patch call into a Conflict instead
+	// of silently clobbering a recreated pod. Diffing the rest of oldPod
+	// (not just its status) against newBase is what lets fns observe drift
+	// in .spec/.metadata, not just in the fields being patched.
+	oldPodCopy := oldPod.DeepCopy()
+	oldPodCopy.UID = ""
+	oldData, err := json.Marshal(oldPodCopy)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal old pod %s/%s: %v", namespace, name, err)
+	}
+
+	newPod := newBase.DeepCopy()
+	newPod.UID = uid
+	newPod.Status = newStatus
+	newData, err := json.Marshal(newPod)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal new pod %s/%s: %v", namespace, name, err)
+	}
+
+	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, &v1.Pod{}, fns...)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create two-way merge patch for pod %s/%s: %w", namespace, name, err)
+	}
+	return patchBytes, false, nil
+}
+
+// PatchPodStatusDelta is like PatchPodStatus, but instead of marshalling
+// oldPod.Status and newStatus wholesale, it first diffs them field-by-field
+// and only feeds the fields that actually changed to
+// strategicpatch.CreateTwoWayMergePatch. Conditions are diffed as a set keyed
+// by Type rather than compared as a whole slice, so a condition that didn't
+// change never even makes it into the comparison, let alone the patch. This
+// keeps the wire payload proportional to what changed rather than to the
+// size of the whole status, which matters for pods with long condition or
+// container-status lists.
+//
+// As with PatchPodStatus, the API round-trip is skipped entirely when
+// nothing changed, and oldPod.UID is folded in as an implicit precondition.
+func PatchPodStatusDelta(ctx context.Context, cs kubernetes.Interface, oldPod *v1.Pod, newStatus *v1.PodStatus) error {
+	oldDelta, newDelta, changed := diffPodStatus(&oldPod.Status, newStatus)
+	if !changed {
+		return nil
+	}
+
+	oldData, err := json.Marshal(v1.Pod{Status: oldDelta})
+	if err != nil {
+		return fmt.Errorf("failed to marshal old status delta for pod %s/%s: %v", oldPod.Namespace, oldPod.Name, err)
+	}
+	newData, err := json.Marshal(v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{UID: oldPod.UID},
+		Status:     newDelta,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal new status delta for pod %s/%s: %v", oldPod.Namespace, oldPod.Name, err)
+	}
+
+	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, &v1.Pod{})
+	if err != nil {
+		return fmt.Errorf("failed to create two-way merge patch for pod %s/%s: %v", oldPod.Namespace, oldPod.Name, err)
+	}
+	if isEmptyStatusPatch(patchBytes) {
+		return nil
+	}
+
+	if _, err := cs.CoreV1().Pods(oldPod.Namespace).Patch(ctx, oldPod.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{}, "status"); err != nil {
+		return fmt.Errorf("failed to patch status %q for pod %s/%s: %w", patchBytes, oldPod.Namespace, oldPod.Name, err)
+	}
+	return nil
+}
+
+// isEmptyStatusPatch reports whether patchBytes is a no-op patch, either
+// because nothing changed at all ("{}") or because the only thing in it is
+// an (unexported) empty status object ("{\"status\":{}}").
+func isEmptyStatusPatch(patchBytes []byte) bool {
+	return bytes.Equal(patchBytes, []byte("{}")) || bytes.Equal(patchBytes, []byte(`{"status":{}}`))
+}
+
+// diffPodStatus builds oldDelta and newDelta PodStatus values containing
+// only the top-level fields that differ between oldStatus and newStatus.
+// changed is false when there is no difference at all. Conditions are
+// handled separately by diffConditions rather than by the generic
+// field-by-field reflection below, since they need set-by-Type semantics
+// rather than whole-slice equality.
+func diffPodStatus(oldStatus, newStatus *v1.PodStatus) (oldDelta, newDelta v1.PodStatus, changed bool) {
+	oldVal := reflect.ValueOf(*oldStatus)
+	newVal := reflect.ValueOf(*newStatus)
+	oldOut := reflect.ValueOf(&oldDelta).Elem()
+	newOut := reflect.ValueOf(&newDelta).Elem()
+
+	t := oldVal.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Name == "Conditions" {
+			continue
+		}
+		of, nf := oldVal.Field(i), newVal.Field(i)
+		if reflect.DeepEqual(of.Interface(), nf.Interface()) {
+			continue
+		}
+		oldOut.Field(i).Set(of)
+		newOut.Field(i).Set(nf)
+		changed = true
+	}
+
+	if oldConditions, newConditions, condChanged := diffConditions(oldStatus.Conditions, newStatus.Conditions); condChanged {
+		oldDelta.Conditions = oldConditions
+		newDelta.Conditions = newConditions
+		changed = true
+	}
+	return oldDelta, newDelta, changed
+}
+
+// diffConditions treats oldConditions and newConditions as sets keyed by
+// Type and returns only the entries that were added, removed, or modified.
+// Conditions that are identical on both sides never appear in either
+// returned slice.
+func diffConditions(oldConditions, newConditions []v1.PodCondition) (oldDelta, newDelta []v1.PodCondition, changed bool) {
+	oldByType := make(map[v1.PodConditionType]v1.PodCondition, len(oldConditions))
+	for _, c := range oldConditions {
+		oldByType[c.Type] = c
+	}
+
+	for _, newCond := range newConditions {
+		oldCond, existed := oldByType[newCond.Type]
+		if existed && reflect.DeepEqual(oldCond, newCond) {
+			continue
+		}
+		if existed {
+			oldDelta = append(oldDelta, oldCond)
+		}
+		newDelta = append(newDelta, newCond)
+		changed = true
+	}
+
+	newByType := make(map[v1.PodConditionType]bool, len(newConditions))
+	for _, c := range newConditions {
+		newByType[c.Type] = true
+	}
+	for _, oldCond := range oldConditions {
+		if !newByType[oldCond.Type] {
+			oldDelta = append(oldDelta, oldCond)
+			changed = true
+		}
+	}
+	return oldDelta, newDelta, changed
+}
@@ -0,0 +1,427 @@
+package podutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/mergepatch"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/Huang-Wei/tryout-kube-strategic-merge-patch/pkg/preconditions"
+)
+
+func newTestPod(uid types.UID) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: uid},
+		Status:     v1.PodStatus{NominatedNodeName: ""},
+	}
+}
+
+func TestPatchPodStatusUnchanged(t *testing.T) {
+	pod := newTestPod("real-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+	cs.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		t.Fatal("Patch should not be called when the status hasn't changed")
+		return false, nil, nil
+	})
+
+	updatedPod, patchBytes, unchanged, err := PatchPodStatus(context.TODO(), cs, pod, *pod.Status.DeepCopy(), PatchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !unchanged {
+		t.Fatalf("expected unchanged=true, got false (patch=%s)", patchBytes)
+	}
+	if updatedPod != nil {
+		t.Fatalf("expected a nil pod when unchanged, got %v", updatedPod)
+	}
+}
+
+func TestPatchPodStatusChanged(t *testing.T) {
+	pod := newTestPod("real-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	newStatus := pod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	updatedPod, _, unchanged, err := PatchPodStatus(context.TODO(), cs, pod, *newStatus, PatchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unchanged {
+		t.Fatal("expected unchanged=false")
+	}
+	if got := updatedPod.Status.NominatedNodeName; got != "minikube" {
+		t.Fatalf("expected NominatedNodeName %q, got %q", "minikube", got)
+	}
+}
+
+// TestPatchPodStatusUIDMismatch simulates how a real API server enforces the
+// implicit uid precondition injected by preparePatchBytesForPodStatus: uid is
+// immutable, so a patch that tries to change it is rejected. The fake
+// clientset's ObjectTracker doesn't perform that validation itself, so the
+// reactor below stands in for the API server.
+func TestPatchPodStatusUIDMismatch(t *testing.T) {
+	pod := newTestPod("live-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+	cs.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(k8stesting.PatchAction)
+		var patch struct {
+			Metadata struct {
+				UID types.UID `json:"uid"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(patchAction.GetPatch(), &patch); err != nil {
+			return false, nil, err
+		}
+		if patch.Metadata.UID != "" && patch.Metadata.UID != pod.UID {
+			return true, nil, apierrors.NewConflict(v1.Resource("pods"), pod.Name, fmt.Errorf("uid mismatch: pod has been recreated"))
+		}
+		return false, nil, nil
+	})
+
+	staleViewOfPod := pod.DeepCopy()
+	staleViewOfPod.UID = "stale-uid"
+	newStatus := staleViewOfPod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	_, _, _, err := PatchPodStatus(context.TODO(), cs, staleViewOfPod, *newStatus, PatchOptions{})
+	if err == nil {
+		t.Fatal("expected an error patching with a stale uid, got nil")
+	}
+	if !apierrors.IsConflict(err) {
+		t.Fatalf("expected a conflict error, got %v", err)
+	}
+}
+
+// TestPatchPodStatusPreconditionSeesLiveDrift exercises the reason
+// PatchPodStatus re-fetches the live pod whenever fns is non-empty: a
+// precondition must be able to observe drift that happened to the live
+// object after the caller's oldPod was fetched, such as a concurrent Bind
+// setting .spec.nodeName. Diffing oldPod against itself (or patching
+// status alone) would never show that change.
+func TestPatchPodStatusPreconditionSeesLiveDrift(t *testing.T) {
+	pod := newTestPod("real-uid")
+	staleViewOfPod := pod.DeepCopy() // fetched before NodeName was bound
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	if _, err := cs.CoreV1().Pods(pod.Namespace).Patch(
+		context.TODO(), pod.Name, types.StrategicMergePatchType,
+		[]byte(`{"spec":{"nodeName":"minikube"}}`), metav1.PatchOptions{},
+	); err != nil {
+		t.Fatalf("failed to simulate a concurrent bind: %v", err)
+	}
+
+	newStatus := staleViewOfPod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	_, _, _, err := PatchPodStatus(context.TODO(), cs, staleViewOfPod, *newStatus, PatchOptions{}, preconditions.RequireJSONPathUnchanged("spec.nodeName"))
+	if err == nil {
+		t.Fatal("expected the precondition to reject a patch against a pod whose spec.nodeName changed, got nil")
+	}
+	var preconditionErr mergepatch.ErrPreconditionFailed
+	if !errors.As(err, &preconditionErr) {
+		t.Fatalf("expected a precondition-failed error, got %v", err)
+	}
+}
+
+func TestPatchPodStatusJSONPatchType(t *testing.T) {
+	pod := newTestPod("real-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	newStatus := pod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	updatedPod, patchBytes, unchanged, err := PatchPodStatus(context.TODO(), cs, pod, *newStatus, PatchOptions{PatchType: types.JSONPatchType})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unchanged {
+		t.Fatal("expected unchanged=false")
+	}
+	if !bytes.Contains(patchBytes, []byte(`"op":"test"`)) || !bytes.Contains(patchBytes, []byte("/metadata/uid")) {
+		t.Fatalf("expected a uid test op in the JSON patch, got %s", patchBytes)
+	}
+	if got := updatedPod.Status.NominatedNodeName; got != "minikube" {
+		t.Fatalf("expected NominatedNodeName %q, got %q", "minikube", got)
+	}
+}
+
+// TestPatchPodStatusJSONPatchTypePreconditionIsClientSideOnly documents the
+// gap called out on the PatchPodStatus doc comment: fns is still evaluated
+// (against a live read, same as every other PatchType) before a JSON Patch
+// is built, so drift that already happened is caught - but the resulting
+// patch carries no "test" op for the guarded path, only for uid, so drift
+// that happens after this check and before the Patch call is not caught at
+// the wire level the way it would be for types.StrategicMergePatchType.
+func TestPatchPodStatusJSONPatchTypePreconditionIsClientSideOnly(t *testing.T) {
+	pod := newTestPod("real-uid")
+	staleViewOfPod := pod.DeepCopy() // fetched before NodeName was bound
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	if _, err := cs.CoreV1().Pods(pod.Namespace).Patch(
+		context.TODO(), pod.Name, types.StrategicMergePatchType,
+		[]byte(`{"spec":{"nodeName":"minikube"}}`), metav1.PatchOptions{},
+	); err != nil {
+		t.Fatalf("failed to simulate a concurrent bind: %v", err)
+	}
+
+	newStatus := staleViewOfPod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	_, _, _, err := PatchPodStatus(context.TODO(), cs, staleViewOfPod, *newStatus, PatchOptions{PatchType: types.JSONPatchType}, preconditions.RequireJSONPathUnchanged("spec.nodeName"))
+	if err == nil {
+		t.Fatal("expected the precondition to reject a patch against a pod whose spec.nodeName already changed, got nil")
+	}
+	var preconditionErr mergepatch.ErrPreconditionFailed
+	if !errors.As(err, &preconditionErr) {
+		t.Fatalf("expected a precondition-failed error, got %v", err)
+	}
+
+	// Now show the other half of the gap: once the check above passes,
+	// nothing about "spec.nodeName" makes it into the JSON patch itself.
+	freshPod := staleViewOfPod.DeepCopy()
+	freshPod.Spec.NodeName = "minikube" // catch up to the live object
+	patchBytes, err := jsonPatchBytesForPodStatus(freshPod.UID, freshPod.Status, *newStatus)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(patchBytes, []byte("nodeName")) {
+		t.Fatalf("expected no nodeName test op in the JSON patch (only uid is carried), got %s", patchBytes)
+	}
+}
+
+func TestPatchPodStatusJSONPatchTypeUIDMismatch(t *testing.T) {
+	pod := newTestPod("live-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	staleViewOfPod := pod.DeepCopy()
+	staleViewOfPod.UID = "stale-uid"
+	newStatus := staleViewOfPod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	_, _, _, err := PatchPodStatus(context.TODO(), cs, staleViewOfPod, *newStatus, PatchOptions{PatchType: types.JSONPatchType})
+	if err == nil {
+		t.Fatal("expected an error patching with a stale uid, got nil")
+	}
+}
+
+// TestPatchPodStatusApplyPatchTypeUIDMismatch mirrors
+// TestPatchPodStatusUIDMismatch: applyPatchBytesForPodStatus must carry the
+// caller's remembered uid just like the other two patch types, or a stale
+// caller could silently apply its status to a pod that was deleted and
+// recreated under the same name.
+func TestPatchPodStatusApplyPatchTypeUIDMismatch(t *testing.T) {
+	pod := newTestPod("live-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+	cs.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(k8stesting.PatchAction)
+		var apply struct {
+			Metadata struct {
+				UID types.UID `json:"uid"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(patchAction.GetPatch(), &apply); err != nil {
+			return false, nil, err
+		}
+		if apply.Metadata.UID != "" && apply.Metadata.UID != pod.UID {
+			return true, nil, apierrors.NewConflict(v1.Resource("pods"), pod.Name, fmt.Errorf("uid mismatch: pod has been recreated"))
+		}
+		return false, nil, nil
+	})
+
+	staleViewOfPod := pod.DeepCopy()
+	staleViewOfPod.UID = "stale-uid"
+	newStatus := staleViewOfPod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	_, _, _, err := PatchPodStatus(context.TODO(), cs, staleViewOfPod, *newStatus, PatchOptions{PatchType: types.ApplyPatchType, FieldManager: "podutil-test"})
+	if err == nil {
+		t.Fatal("expected an error patching with a stale uid, got nil")
+	}
+	if !apierrors.IsConflict(err) {
+		t.Fatalf("expected a conflict error, got %v", err)
+	}
+}
+
+func TestPatchPodStatusApplyPatchTypeRequiresFieldManager(t *testing.T) {
+	pod := newTestPod("real-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	newStatus := pod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	_, _, _, err := PatchPodStatus(context.TODO(), cs, pod, *newStatus, PatchOptions{PatchType: types.ApplyPatchType})
+	if err == nil {
+		t.Fatal("expected an error when FieldManager is empty")
+	}
+}
+
+func TestPatchPodStatusApplyPatchType(t *testing.T) {
+	pod := newTestPod("real-uid")
+	pod.Status.Phase = v1.PodPending
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	var patchBytes []byte
+	cs.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchBytes = action.(k8stesting.PatchAction).GetPatch()
+		return false, nil, nil
+	})
+
+	newStatus := pod.Status.DeepCopy()
+	newStatus.NominatedNodeName = "minikube"
+	updatedPod, _, unchanged, err := PatchPodStatus(context.TODO(), cs, pod, *newStatus, PatchOptions{PatchType: types.ApplyPatchType, FieldManager: "podutil-test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if unchanged {
+		t.Fatal("expected unchanged=false")
+	}
+	if bytes.Contains(patchBytes, []byte(string(v1.PodPending))) {
+		t.Fatalf("expected the unchanged phase to be left out of the apply configuration, got %s", patchBytes)
+	}
+	if got := updatedPod.Status.NominatedNodeName; got != "minikube" {
+		t.Fatalf("expected NominatedNodeName %q, got %q", "minikube", got)
+	}
+	if got := updatedPod.Status.Phase; got != v1.PodPending {
+		t.Fatalf("expected the untouched Phase to survive, got %q", got)
+	}
+}
+
+func TestPatchPodStatusDeltaUnchanged(t *testing.T) {
+	pod := newTestPod("real-uid")
+	pod.Status.Conditions = []v1.PodCondition{
+		{Type: v1.PodReady, Status: v1.ConditionTrue},
+	}
+	cs := fakeclientset.NewSimpleClientset(pod)
+	cs.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		t.Fatal("Patch should not be called when the status hasn't changed")
+		return false, nil, nil
+	})
+
+	if err := PatchPodStatusDelta(context.TODO(), cs, pod, pod.Status.DeepCopy()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPatchPodStatusDeltaOnlyTouchesChangedConditions(t *testing.T) {
+	pod := newTestPod("real-uid")
+	pod.Status.Conditions = []v1.PodCondition{
+		{Type: v1.PodScheduled, Status: v1.ConditionTrue},
+		{Type: v1.PodReady, Status: v1.ConditionFalse},
+	}
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	var patchBytes []byte
+	cs.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchBytes = action.(k8stesting.PatchAction).GetPatch()
+		return false, nil, nil
+	})
+
+	newStatus := pod.Status.DeepCopy()
+	newStatus.Conditions[1].Status = v1.ConditionTrue // only PodReady actually changes
+	if err := PatchPodStatusDelta(context.TODO(), cs, pod, newStatus); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if bytes.Contains(patchBytes, []byte(string(v1.PodScheduled))) {
+		t.Fatalf("expected the unchanged PodScheduled condition to be left out of the patch, got %s", patchBytes)
+	}
+	if !bytes.Contains(patchBytes, []byte(string(v1.PodReady))) {
+		t.Fatalf("expected the changed PodReady condition in the patch, got %s", patchBytes)
+	}
+
+	updatedPod, err := cs.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range updatedPod.Status.Conditions {
+		if c.Type == v1.PodReady && c.Status != v1.ConditionTrue {
+			t.Fatalf("expected PodReady to be patched to True, got %v", c.Status)
+		}
+		if c.Type == v1.PodScheduled && c.Status != v1.ConditionTrue {
+			t.Fatalf("expected PodScheduled to be left untouched, got %v", c.Status)
+		}
+	}
+}
+
+func TestDiffConditions(t *testing.T) {
+	tests := []struct {
+		name             string
+		old, new         []v1.PodCondition
+		wantOld, wantNew []v1.PodConditionType
+		wantChanged      bool
+	}{
+		{
+			name:        "identical",
+			old:         []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			new:         []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			wantChanged: false,
+		},
+		{
+			name:        "modified",
+			old:         []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionFalse}},
+			new:         []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			wantOld:     []v1.PodConditionType{v1.PodReady},
+			wantNew:     []v1.PodConditionType{v1.PodReady},
+			wantChanged: true,
+		},
+		{
+			name:        "added",
+			old:         nil,
+			new:         []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			wantNew:     []v1.PodConditionType{v1.PodReady},
+			wantChanged: true,
+		},
+		{
+			name:        "removed",
+			old:         []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			new:         nil,
+			wantOld:     []v1.PodConditionType{v1.PodReady},
+			wantChanged: true,
+		},
+		{
+			name: "unrelated condition left out",
+			old: []v1.PodCondition{
+				{Type: v1.PodScheduled, Status: v1.ConditionTrue},
+				{Type: v1.PodReady, Status: v1.ConditionFalse},
+			},
+			new: []v1.PodCondition{
+				{Type: v1.PodScheduled, Status: v1.ConditionTrue},
+				{Type: v1.PodReady, Status: v1.ConditionTrue},
+			},
+			wantOld:     []v1.PodConditionType{v1.PodReady},
+			wantNew:     []v1.PodConditionType{v1.PodReady},
+			wantChanged: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldDelta, newDelta, changed := diffConditions(tt.old, tt.new)
+			if changed != tt.wantChanged {
+				t.Fatalf("changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if got := conditionTypes(oldDelta); !reflect.DeepEqual(got, tt.wantOld) {
+				t.Errorf("oldDelta types = %v, want %v", got, tt.wantOld)
+			}
+			if got := conditionTypes(newDelta); !reflect.DeepEqual(got, tt.wantNew) {
+				t.Errorf("newDelta types = %v, want %v", got, tt.wantNew)
+			}
+		})
+	}
+}
+
+func conditionTypes(conditions []v1.PodCondition) []v1.PodConditionType {
+	if len(conditions) == 0 {
+		return nil
+	}
+	types := make([]v1.PodConditionType, 0, len(conditions))
+	for _, c := range conditions {
+		types = append(types, c.Type)
+	}
+	return types
+}
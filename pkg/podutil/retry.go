@@ -0,0 +1,55 @@
+package podutil
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/mergepatch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// UpdatePodStatusWithRetry fetches the live pod, applies mutate to a deep
+// copy of it, and calls UpdateStatus, retrying with the default backoff
+// whenever the update fails with a Conflict. mutate is invoked fresh on
+// every attempt, so it should derive the desired status from the pod it's
+// given rather than from a snapshot captured outside the retry loop.
+func UpdatePodStatusWithRetry(ctx context.Context, cs kubernetes.Interface, namespace, name string, mutate func(*v1.Pod) error) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		pod, err := cs.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		podCopy := pod.DeepCopy()
+		if err := mutate(podCopy); err != nil {
+			return err
+		}
+
+		_, err = cs.CoreV1().Pods(namespace).UpdateStatus(ctx, podCopy, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// PatchPodStatusWithRetry is the Patch counterpart to
+// UpdatePodStatusWithRetry. On every attempt it re-fetches the live pod and
+// re-runs mutate against its status, so the patch handed to PatchPodStatus
+// always reflects the latest server state instead of the possibly-stale
+// status that lost the previous attempt.
+func PatchPodStatusWithRetry(ctx context.Context, cs kubernetes.Interface, namespace, name string, mutate func(*v1.PodStatus) error, opts PatchOptions, fns ...mergepatch.PreconditionFunc) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		pod, err := cs.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		newStatus := pod.Status.DeepCopy()
+		if err := mutate(newStatus); err != nil {
+			return err
+		}
+
+		_, _, _, err = PatchPodStatus(ctx, cs, pod, *newStatus, opts, fns...)
+		return err
+	})
+}
@@ -0,0 +1,97 @@
+package podutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakeclientset "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestUpdatePodStatusWithRetryRetriesOnConflict(t *testing.T) {
+	pod := newTestPod("real-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	var attempts int
+	cs.PrependReactor("update", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+		attempts++
+		if attempts == 1 {
+			return true, nil, apierrors.NewConflict(v1.Resource("pods"), pod.Name, fmt.Errorf("stale resourceVersion"))
+		}
+		return false, nil, nil
+	})
+
+	err := UpdatePodStatusWithRetry(context.TODO(), cs, pod.Namespace, pod.Name, func(p *v1.Pod) error {
+		p.Status.NominatedNodeName = "minikube"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+
+	updatedPod, err := cs.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := updatedPod.Status.NominatedNodeName; got != "minikube" {
+		t.Fatalf("expected NominatedNodeName %q, got %q", "minikube", got)
+	}
+}
+
+func TestUpdatePodStatusWithRetryPropagatesNonConflictError(t *testing.T) {
+	pod := newTestPod("real-uid")
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	wantErr := fmt.Errorf("boom")
+	err := UpdatePodStatusWithRetry(context.TODO(), cs, pod.Namespace, pod.Name, func(p *v1.Pod) error {
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("expected mutate's error to propagate unchanged, got %v", err)
+	}
+}
+
+func TestPatchPodStatusWithRetryUsesFreshStatusOnRetry(t *testing.T) {
+	pod := newTestPod("real-uid")
+	pod.Status.NominatedNodeName = "minikube"
+	cs := fakeclientset.NewSimpleClientset(pod)
+
+	var attempts int
+	cs.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		attempts++
+		if attempts == 1 {
+			return true, nil, apierrors.NewConflict(v1.Resource("pods"), pod.Name, fmt.Errorf("stale uid"))
+		}
+		return false, nil, nil
+	})
+
+	err := PatchPodStatusWithRetry(context.TODO(), cs, pod.Namespace, pod.Name, func(s *v1.PodStatus) error {
+		s.NominatedNodeName = ""
+		return nil
+	}, PatchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+
+	updatedPod, err := cs.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := updatedPod.Status.NominatedNodeName; got != "" {
+		t.Fatalf("expected NominatedNodeName to be cleared, got %q", got)
+	}
+}
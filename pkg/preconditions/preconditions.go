@@ -0,0 +1,146 @@
+// Package preconditions generalizes the ad-hoc RequireSpecKeyUnchanged
+// helper into a small library of composable mergepatch.PreconditionFunc
+// builders for guarding strategic-merge patches against touching fields the
+// caller doesn't expect to change.
+package preconditions
+
+import (
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/mergepatch"
+)
+
+// RequireJSONPathUnchanged returns a mergepatch.PreconditionFunc that rejects
+// a patch which touches the field at path. path is a slash- or
+// dot-separated walk through the patch's nested maps, with numeric segments
+// indexing into arrays (e.g. "spec/containers/0/image").
+//
+// A missing intermediate map, a non-map/non-array value where a segment
+// expects one, or an out-of-range index are all treated the same as the
+// path simply not being in the patch: the precondition holds, matching the
+// semantics of the RequireSpecKeyUnchanged helper this generalizes.
+func RequireJSONPathUnchanged(path string) mergepatch.PreconditionFunc {
+	segments := splitPath(path)
+	return func(patch interface{}) bool {
+		return !pathPresent(patch, segments)
+	}
+}
+
+// RequireNoFieldsAdded is RequireJSONPathUnchanged applied to several paths
+// at once: the patch must leave every one of them untouched.
+func RequireNoFieldsAdded(paths ...string) mergepatch.PreconditionFunc {
+	fns := make([]mergepatch.PreconditionFunc, 0, len(paths))
+	for _, path := range paths {
+		fns = append(fns, RequireJSONPathUnchanged(path))
+	}
+	return All(fns...)
+}
+
+// RequireLabelUnchanged rejects a patch that sets or removes the label key.
+// Unlike RequireJSONPathUnchanged, key is matched literally rather than
+// split on "." or "/", since label keys routinely contain both (e.g.
+// "app.kubernetes.io/name").
+func RequireLabelUnchanged(key string) mergepatch.PreconditionFunc {
+	return requireMapKeyUnchanged([]string{"metadata", "labels"}, key)
+}
+
+// RequireAnnotationUnchanged rejects a patch that sets or removes the
+// annotation key. As with RequireLabelUnchanged, key is matched literally.
+func RequireAnnotationUnchanged(key string) mergepatch.PreconditionFunc {
+	return requireMapKeyUnchanged([]string{"metadata", "annotations"}, key)
+}
+
+// All combines fns into a single PreconditionFunc that holds only if every
+// one of them holds. An empty All always holds.
+func All(fns ...mergepatch.PreconditionFunc) mergepatch.PreconditionFunc {
+	return func(patch interface{}) bool {
+		for _, fn := range fns {
+			if !fn(patch) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Any combines fns into a single PreconditionFunc that holds if at least one
+// of them holds. An empty Any never holds, since there is no alternative
+// left to satisfy it.
+func Any(fns ...mergepatch.PreconditionFunc) mergepatch.PreconditionFunc {
+	return func(patch interface{}) bool {
+		for _, fn := range fns {
+			if fn(patch) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func splitPath(path string) []string {
+	path = strings.ReplaceAll(path, ".", "/")
+	var segments []string
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// pathPresent reports whether segments can be fully walked starting at node.
+func pathPresent(node interface{}, segments []string) bool {
+	if len(segments) == 0 {
+		return true
+	}
+
+	seg := segments[0]
+	switch v := node.(type) {
+	case map[string]interface{}:
+		child, ok := v[seg]
+		if !ok {
+			return false
+		}
+		return pathPresent(child, segments[1:])
+	case []interface{}:
+		idx, err := strconv.Atoi(seg)
+		if err != nil || idx < 0 || idx >= len(v) {
+			return false
+		}
+		return pathPresent(v[idx], segments[1:])
+	default:
+		return false
+	}
+}
+
+// requireMapKeyUnchanged rejects a patch that has a map at parents
+// containing key. A missing intermediate map, or no map at all at parents,
+// means the precondition holds.
+func requireMapKeyUnchanged(parents []string, key string) mergepatch.PreconditionFunc {
+	return func(patch interface{}) bool {
+		node := navigateMaps(patch, parents)
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return true
+		}
+		_, present := m[key]
+		return !present
+	}
+}
+
+// navigateMaps walks node through a fixed sequence of map keys, returning
+// nil as soon as a segment is missing or the current node isn't a map.
+func navigateMaps(node interface{}, segments []string) interface{} {
+	for _, seg := range segments {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node, ok = m[seg]
+		if !ok {
+			return nil
+		}
+	}
+	return node
+}
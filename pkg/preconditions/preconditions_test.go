@@ -0,0 +1,133 @@
+package preconditions
+
+import "testing"
+
+func TestRequireJSONPathUnchanged(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		patch interface{}
+		want  bool
+	}{
+		{
+			name:  "path absent",
+			path:  "spec/nodeName",
+			patch: map[string]interface{}{"status": map[string]interface{}{"phase": "Running"}},
+			want:  true,
+		},
+		{
+			name:  "top-level key present",
+			path:  "spec/nodeName",
+			patch: map[string]interface{}{"spec": map[string]interface{}{"nodeName": "node-1"}},
+			want:  false,
+		},
+		{
+			name:  "dot-separated path",
+			path:  "spec.nodeName",
+			patch: map[string]interface{}{"spec": map[string]interface{}{"nodeName": "node-1"}},
+			want:  false,
+		},
+		{
+			name:  "nested path present",
+			path:  "status/containerStatuses/0/ready",
+			patch: map[string]interface{}{"status": map[string]interface{}{"containerStatuses": []interface{}{map[string]interface{}{"ready": true}}}},
+			want:  false,
+		},
+		{
+			name:  "array index out of range",
+			path:  "status/containerStatuses/1/ready",
+			patch: map[string]interface{}{"status": map[string]interface{}{"containerStatuses": []interface{}{map[string]interface{}{"ready": true}}}},
+			want:  true,
+		},
+		{
+			name:  "non-map intermediate value",
+			path:  "spec/nodeName/extra",
+			patch: map[string]interface{}{"spec": map[string]interface{}{"nodeName": "node-1"}},
+			want:  true,
+		},
+		{
+			name:  "patch isn't a map",
+			path:  "spec/nodeName",
+			patch: "not a map",
+			want:  true,
+		},
+		{
+			name:  "nil patch",
+			path:  "spec/nodeName",
+			patch: nil,
+			want:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RequireJSONPathUnchanged(tt.path)(tt.patch); got != tt.want {
+				t.Errorf("RequireJSONPathUnchanged(%q)(patch) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireNoFieldsAdded(t *testing.T) {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{"nodeName": "node-1"},
+	}
+
+	if RequireNoFieldsAdded("spec/nodeName", "spec/schedulerName")(patch) {
+		t.Error("expected a violation when one of the guarded paths is present")
+	}
+	if !RequireNoFieldsAdded("spec/schedulerName", "spec/priority")(patch) {
+		t.Error("expected no violation when none of the guarded paths are present")
+	}
+}
+
+func TestRequireLabelAndAnnotationUnchanged(t *testing.T) {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{"app.kubernetes.io/name": "foo"},
+			"annotations": map[string]interface{}{"example.com/owner": "team-a"},
+		},
+	}
+
+	if RequireLabelUnchanged("app.kubernetes.io/name")(patch) {
+		t.Error("expected a violation for a changed label with dots and a slash in its key")
+	}
+	if !RequireLabelUnchanged("other-label")(patch) {
+		t.Error("expected no violation for a label key absent from the patch")
+	}
+	if RequireAnnotationUnchanged("example.com/owner")(patch) {
+		t.Error("expected a violation for a changed annotation")
+	}
+	if !RequireAnnotationUnchanged("other-annotation")(patch) {
+		t.Error("expected no violation for an annotation key absent from the patch")
+	}
+
+	if !RequireLabelUnchanged("x")(map[string]interface{}{"spec": map[string]interface{}{}}) {
+		t.Error("expected no violation when metadata.labels isn't present at all")
+	}
+}
+
+func TestAllAndAny(t *testing.T) {
+	pass := func(interface{}) bool { return true }
+	fail := func(interface{}) bool { return false }
+
+	if !All()(nil) {
+		t.Error("empty All should hold")
+	}
+	if !All(pass, pass)(nil) {
+		t.Error("All of passing funcs should hold")
+	}
+	if All(pass, fail)(nil) {
+		t.Error("All should fail if any func fails")
+	}
+
+	if Any()(nil) {
+		t.Error("empty Any should not hold")
+	}
+	if !Any(fail, pass)(nil) {
+		t.Error("Any should hold if at least one func holds")
+	}
+	if Any(fail, fail)(nil) {
+		t.Error("Any should fail if every func fails")
+	}
+}